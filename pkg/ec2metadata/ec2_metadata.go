@@ -0,0 +1,219 @@
+// Copyright 2017 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package ec2metadata wraps access to the EC2 Instance Metadata Service (IMDS),
+// preferring IMDSv2 session-oriented token requests over the unauthenticated
+// IMDSv1 requests.
+package ec2metadata
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	metadataURLBase = "http://169.254.169.254/latest"
+
+	tokenPath           = "/api/token"
+	tokenTTLHeader      = "X-aws-ec2-metadata-token-ttl-seconds"
+	tokenHeader         = "X-aws-ec2-metadata-token"
+	tokenTTLSeconds     = 21600
+	tokenRefreshPercent = 0.8
+
+	metadataRequestTimeout = 2 * time.Second
+)
+
+// EC2Metadata provides access to the EC2 instance metadata service
+type EC2Metadata interface {
+	GetMetadata(path string) (string, error)
+}
+
+// ec2MetadataClient implements the EC2Metadata interface on top of the IMDSv2
+// token based protocol, falling back to IMDSv1 when configured to do so
+type ec2MetadataClient struct {
+	httpClient *http.Client
+	config     Config
+
+	tokenLock  sync.Mutex
+	token      string
+	tokenUntil time.Time
+}
+
+// Config controls how the EC2Metadata client talks to IMDS
+type Config struct {
+	// AllowIMDSv1Fallback permits the client to fall back to unauthenticated
+	// IMDSv1 requests when the IMDSv2 token PUT fails. This should only be
+	// enabled for instances that cannot be moved to HttpTokens=required.
+	AllowIMDSv1Fallback bool
+}
+
+// NewEC2Metadata creates a new EC2Metadata client that uses IMDSv2 session
+// tokens, with IMDSv1 fallback disabled
+func NewEC2Metadata() EC2Metadata {
+	return NewEC2MetadataWithConfig(Config{})
+}
+
+// NewEC2MetadataWithConfig creates a new EC2Metadata client using the given
+// Config
+func NewEC2MetadataWithConfig(config Config) EC2Metadata {
+	return &ec2MetadataClient{
+		httpClient: &http.Client{Timeout: metadataRequestTimeout},
+		config:     config,
+	}
+}
+
+// GetMetadata gets the value at the given path from the instance metadata
+// service, obtaining an IMDSv2 session token first if one isn't already
+// cached
+func (c *ec2MetadataClient) GetMetadata(path string) (string, error) {
+	token, err := c.getToken()
+	if err != nil {
+		if !c.config.AllowIMDSv1Fallback {
+			return "", errors.Wrap(err,
+				"ec2metadata: unable to obtain IMDSv2 token and IMDSv1 fallback is disabled")
+		}
+		return c.getMetadataWithToken(path, "")
+	}
+
+	body, err := c.getMetadataWithToken(path, token)
+	if err == nil {
+		return body, nil
+	}
+
+	if !isUnauthorized(err) {
+		return "", err
+	}
+
+	// The cached token may have been invalidated out from under us (eg the
+	// instance's hop limit or token lifetime changed). Fetch a fresh one and
+	// retry exactly once.
+	token, tokenErr := c.refreshToken()
+	if tokenErr != nil {
+		if c.config.AllowIMDSv1Fallback {
+			return c.getMetadataWithToken(path, "")
+		}
+		return "", errors.Wrap(tokenErr, "ec2metadata: unable to refresh IMDSv2 token after 401/403")
+	}
+
+	return c.getMetadataWithToken(path, token)
+}
+
+// getToken returns a cached, unexpired IMDSv2 session token, fetching and
+// caching a new one if necessary
+func (c *ec2MetadataClient) getToken() (string, error) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenUntil) {
+		return c.token, nil
+	}
+
+	return c.fetchToken()
+}
+
+// refreshToken unconditionally fetches a new IMDSv2 session token, replacing
+// any cached value
+func (c *ec2MetadataClient) refreshToken() (string, error) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	return c.fetchToken()
+}
+
+// fetchToken requests a new IMDSv2 session token. Callers must hold
+// tokenLock.
+func (c *ec2MetadataClient) fetchToken() (string, error) {
+	req, err := http.NewRequest(http.MethodPut, metadataURLBase+tokenPath, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "ec2metadata: unable to construct IMDSv2 token request")
+	}
+	req.Header.Set(tokenTTLHeader, strconv.Itoa(tokenTTLSeconds))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "ec2metadata: unable to reach IMDS to obtain a session token")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "ec2metadata: unable to read IMDSv2 token response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", errors.Errorf(
+			"ec2metadata: IMDSv2 token request returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	token := string(body)
+	c.token = token
+	c.tokenUntil = time.Now().Add(time.Duration(float64(tokenTTLSeconds)*tokenRefreshPercent) * time.Second)
+
+	return token, nil
+}
+
+// getMetadataWithToken issues a GET for path, attaching the token header
+// when token is non-empty
+func (c *ec2MetadataClient) getMetadataWithToken(path string, token string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, metadataURLBase+"/meta-data/"+path, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "ec2metadata: unable to construct metadata request")
+	}
+	if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "ec2metadata: unable to reach IMDS for path '%s'", path)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "ec2metadata: unable to read response for path '%s'", path)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", &unauthorizedError{statusCode: resp.StatusCode, path: path}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", errors.Errorf(
+			"ec2metadata: request for path '%s' returned status %d: %s", path, resp.StatusCode, string(body))
+	}
+
+	return string(body), nil
+}
+
+// unauthorizedError indicates that IMDS rejected a request because the
+// session token was missing, expired, or otherwise invalid
+type unauthorizedError struct {
+	statusCode int
+	path       string
+}
+
+func (e *unauthorizedError) Error() string {
+	return errors.Errorf(
+		"ec2metadata: request for path '%s' was unauthorized with status %d", e.path, e.statusCode).Error()
+}
+
+func isUnauthorized(err error) bool {
+	_, ok := errors.Cause(err).(*unauthorizedError)
+	return ok
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isTokenRequest reports whether r is an IMDSv2 token request. Requests
+// arrive at metadataURLBase+tokenPath, so matching on the suffix avoids
+// hardcoding metadataURLBase's "/latest" prefix here.
+func isTokenRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, tokenPath)
+}
+
+// redirectTransport rewrites every request to target instead of its
+// original host, so tests can point a client at metadataURLBase without
+// actually reaching 169.254.169.254.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestClient(t *testing.T, config Config, handler http.Handler) *ec2MetadataClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("unable to parse test server url: %v", err)
+	}
+
+	return &ec2MetadataClient{
+		httpClient: &http.Client{Transport: &redirectTransport{target: target}},
+		config:     config,
+	}
+}
+
+func TestGetMetadataIMDSv2(t *testing.T) {
+	var sawToken string
+	client := newTestClient(t, Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(r) {
+			w.Write([]byte("test-token"))
+			return
+		}
+		sawToken = r.Header.Get(tokenHeader)
+		w.Write([]byte("mac-address-body"))
+	}))
+
+	got, err := client.GetMetadata("network/interfaces/macs/")
+	if err != nil {
+		t.Fatalf("GetMetadata: unexpected error: %v", err)
+	}
+	if got != "mac-address-body" {
+		t.Errorf("GetMetadata: got %q, want %q", got, "mac-address-body")
+	}
+	if sawToken != "test-token" {
+		t.Errorf("GetMetadata: request carried token %q, want %q", sawToken, "test-token")
+	}
+}
+
+func TestGetMetadataCachesToken(t *testing.T) {
+	var tokenRequests int
+	client := newTestClient(t, Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(r) {
+			tokenRequests++
+			w.Write([]byte("test-token"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetMetadata("some/path"); err != nil {
+			t.Fatalf("GetMetadata: unexpected error on call %d: %v", i, err)
+		}
+	}
+
+	if tokenRequests != 1 {
+		t.Errorf("expected the cached token to be reused, got %d token requests", tokenRequests)
+	}
+}
+
+func TestGetMetadataRefreshesExpiredToken(t *testing.T) {
+	var tokenRequests int
+	client := newTestClient(t, Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(r) {
+			tokenRequests++
+			w.Write([]byte("test-token"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	if _, err := client.GetMetadata("some/path"); err != nil {
+		t.Fatalf("GetMetadata: unexpected error: %v", err)
+	}
+
+	// Force the cached token to look expired, so the next call must fetch
+	// a new one instead of reusing it.
+	client.tokenUntil = time.Now().Add(-time.Second)
+
+	if _, err := client.GetMetadata("some/path"); err != nil {
+		t.Fatalf("GetMetadata: unexpected error after expiry: %v", err)
+	}
+	if tokenRequests != 2 {
+		t.Errorf("expected the expired token to trigger a refetch, got %d token requests", tokenRequests)
+	}
+}
+
+func TestGetMetadataRetriesOnceOn401(t *testing.T) {
+	var tokenRequests, unauthorizedResponses int
+	client := newTestClient(t, Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(r) {
+			tokenRequests++
+			w.Write([]byte("test-token"))
+			return
+		}
+		if unauthorizedResponses == 0 {
+			unauthorizedResponses++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	got, err := client.GetMetadata("some/path")
+	if err != nil {
+		t.Fatalf("GetMetadata: unexpected error: %v", err)
+	}
+	if got != "ok" {
+		t.Errorf("GetMetadata: got %q, want %q", got, "ok")
+	}
+	if tokenRequests != 2 {
+		t.Errorf("expected exactly one token refresh after a 401, got %d token requests", tokenRequests)
+	}
+}
+
+func TestGetMetadataFallsBackToIMDSv1WhenAllowed(t *testing.T) {
+	var sawToken string
+	client := newTestClient(t, Config{AllowIMDSv1Fallback: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		sawToken = r.Header.Get(tokenHeader)
+		w.Write([]byte("v1-body"))
+	}))
+
+	got, err := client.GetMetadata("some/path")
+	if err != nil {
+		t.Fatalf("GetMetadata: unexpected error: %v", err)
+	}
+	if got != "v1-body" {
+		t.Errorf("GetMetadata: got %q, want %q", got, "v1-body")
+	}
+	if sawToken != "" {
+		t.Errorf("GetMetadata: expected no token header on IMDSv1 fallback, got %q", sawToken)
+	}
+}
+
+func TestGetMetadataFailsWhenTokenUnavailableAndFallbackDisabled(t *testing.T) {
+	client := newTestClient(t, Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(r) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("should not be reached"))
+	}))
+
+	if _, err := client.GetMetadata("some/path"); err == nil {
+		t.Error("GetMetadata: expected an error when the token request fails and fallback is disabled")
+	}
+}
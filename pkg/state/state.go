@@ -0,0 +1,129 @@
+// Copyright 2017 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package state persists the ENI/MAC/IP mapping chosen for a container's
+// network namespace to disk, so that a later DEL or CHECK doesn't depend on
+// the caller replaying the exact arguments an earlier ADD used.
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDir is the directory state files are written to when the caller
+// doesn't configure one explicitly
+const DefaultDir = "/var/run/ecs-cni/eni/"
+
+// ENIState is the set of fields recorded for a container's ENI attachment.
+// It's serialized as JSON, one file per container namespace.
+type ENIState struct {
+	ENIID       string `json:"eniID"`
+	MACAddress  string `json:"macAddress"`
+	IPV4Address string `json:"ipv4,omitempty"`
+	IPV6Address string `json:"ipv6,omitempty"`
+	IPV4Gateway string `json:"ipv4Gateway,omitempty"`
+	IPV6Gateway string `json:"ipv6Gateway,omitempty"`
+	DeviceName  string `json:"deviceName"`
+	BlockIMDS   bool   `json:"blockIMDS"`
+}
+
+// Store persists and retrieves ENIState, keyed by a container's id and the
+// path to its network namespace
+type Store interface {
+	Get(containerID string, netns string) (*ENIState, error)
+	Save(containerID string, netns string, eniState *ENIState) error
+	Remove(containerID string, netns string) error
+}
+
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore creates a Store that persists state as JSON files under dir.
+// If dir is empty, DefaultDir is used.
+func NewFileStore(dir string) Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &fileStore{dir: dir}
+}
+
+// Get reads back the ENIState previously saved for containerID/netns. It
+// returns a nil ENIState and a nil error if no state has been recorded.
+func (s *fileStore) Get(containerID string, netns string) (*ENIState, error) {
+	path := s.path(containerID, netns)
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "state: unable to read state file '%s'", path)
+	}
+
+	var eniState ENIState
+	if err := json.Unmarshal(body, &eniState); err != nil {
+		return nil, errors.Wrapf(err, "state: unable to parse state file '%s'", path)
+	}
+
+	return &eniState, nil
+}
+
+// Save writes eniState for containerID/netns, creating the state directory
+// if it doesn't already exist
+func (s *fileStore) Save(containerID string, netns string, eniState *ENIState) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errors.Wrapf(err, "state: unable to create state directory '%s'", s.dir)
+	}
+
+	body, err := json.Marshal(eniState)
+	if err != nil {
+		return errors.Wrap(err, "state: unable to marshal state")
+	}
+
+	path := s.path(containerID, netns)
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		return errors.Wrapf(err, "state: unable to write state file '%s'", path)
+	}
+
+	return nil
+}
+
+// Remove deletes any state recorded for containerID/netns. It is not an
+// error if no state file exists.
+func (s *fileStore) Remove(containerID string, netns string) error {
+	path := s.path(containerID, netns)
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "state: unable to remove state file '%s'", path)
+	}
+
+	return nil
+}
+
+func (s *fileStore) path(containerID string, netns string) string {
+	key := containerID + "_" + sanitize(netns)
+	return filepath.Join(s.dir, key+".json")
+}
+
+// sanitize replaces path separators in netns (eg /var/run/netns/cni-xxxx)
+// so it can be embedded in a single file name
+func sanitize(netns string) string {
+	return strings.Replace(strings.Trim(netns, string(os.PathSeparator)), string(os.PathSeparator), "-", -1)
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package state
+
+import (
+	"testing"
+)
+
+func TestSaveGetRoundTrip(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	want := &ENIState{
+		ENIID:       "eni-abc123",
+		MACAddress:  "02:42:ac:11:00:02",
+		IPV4Address: "10.0.0.5/24",
+		IPV6Gateway: "fe80::1%eth1",
+		DeviceName:  "eth1",
+		BlockIMDS:   true,
+	}
+
+	if err := store.Save("container-1", "/var/run/netns/cni-1234", want); err != nil {
+		t.Fatalf("Save: unexpected error: %v", err)
+	}
+
+	got, err := store.Get("container-1", "/var/run/netns/cni-1234")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got == nil {
+		t.Fatal("Get: expected state, got nil")
+	}
+	if *got != *want {
+		t.Errorf("Get: got %+v, want %+v", *got, *want)
+	}
+}
+
+func TestGetMissReturnsNilNil(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	got, err := store.Get("no-such-container", "/var/run/netns/cni-0000")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got != nil {
+		t.Errorf("Get: got %+v, want nil", got)
+	}
+}
+
+func TestRemoveIsIdempotent(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	if err := store.Remove("never-saved", "/var/run/netns/cni-0000"); err != nil {
+		t.Fatalf("Remove: unexpected error removing state that was never saved: %v", err)
+	}
+
+	if err := store.Save("container-1", "/var/run/netns/cni-1234", &ENIState{MACAddress: "02:42:ac:11:00:02"}); err != nil {
+		t.Fatalf("Save: unexpected error: %v", err)
+	}
+	if err := store.Remove("container-1", "/var/run/netns/cni-1234"); err != nil {
+		t.Fatalf("Remove: unexpected error: %v", err)
+	}
+
+	got, err := store.Get("container-1", "/var/run/netns/cni-1234")
+	if err != nil {
+		t.Fatalf("Get: unexpected error after Remove: %v", err)
+	}
+	if got != nil {
+		t.Errorf("Get: got %+v after Remove, want nil", got)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	cases := []struct {
+		netns string
+		want  string
+	}{
+		{"/var/run/netns/cni-1234", "var-run-netns-cni-1234"},
+		{"/var/run/netns/cni-1234/", "var-run-netns-cni-1234"},
+		{"cni-1234", "cni-1234"},
+	}
+
+	for _, c := range cases {
+		if got := sanitize(c.netns); got != c.want {
+			t.Errorf("sanitize(%q) = %q, want %q", c.netns, got, c.want)
+		}
+	}
+}
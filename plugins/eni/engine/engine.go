@@ -22,6 +22,7 @@ import (
 	"github.com/aws/amazon-ecs-cni-plugins/pkg/cninswrapper"
 	"github.com/aws/amazon-ecs-cni-plugins/pkg/ec2metadata"
 	"github.com/aws/amazon-ecs-cni-plugins/pkg/netlinkwrapper"
+	"github.com/aws/amazon-ecs-cni-plugins/pkg/state"
 	"github.com/aws/amazon-ecs-cni-plugins/pkg/utils"
 	log "github.com/cihub/seelog"
 	"github.com/containernetworking/cni/pkg/skel"
@@ -36,6 +37,8 @@ const (
 	metadataNetworkInterfaceIPV4AddressesSuffix = "/local-ipv4s"
 	metadataNetworkInterfaceIPV6AddressesSuffix = "/ipv6s"
 	metadataNetworkInterfaceIPV6CIDRPathSuffix  = "/subnet-ipv6-cidr-blocks"
+	metadataNetworkInterfaceFieldsPathSuffix    = "/"
+	metadataNetworkInterfaceIPV6PrefixSuffix    = "/ipv6-prefix"
 	ipv6GatewayTickDuration                     = 1 * time.Second
 	// zeroLengthIPString is what we expect net.IP.String() to return if the
 	// ip has length 0. We use this to determing if an IP is empty.
@@ -45,6 +48,11 @@ const (
 	// for retrieving the ipv6 gateway ip from the routing table. We give up
 	// after 10 ticks, which corresponds to 10 seconds
 	maxTicksForRetrievingIPV6Gateway = 10
+	// linkLocalIPV6Gateway is the link-local address at which the VPC always
+	// answers IPv6 traffic off of an ENI. Since it's a well-known constant,
+	// there's no need to wait for the kernel to populate a default route for
+	// it in the routing table.
+	linkLocalIPV6Gateway = "fe80::1"
 
 	instanceMetadataMaxRetryCount          = 20
 	instanceMetadataDurationBetweenRetries = 1 * time.Second
@@ -59,12 +67,20 @@ type Engine interface {
 	GetIPV4GatewayNetmask(macAddress string) (string, string, error)
 	GetIPV6PrefixLength(macAddress string) (string, error)
 	GetIPV6Gateway(deviceName string) (string, error)
+	GetIPV6GatewayLinkLocal(deviceName string) (string, error)
 	DoesMACAddressMapToIPV4Address(macAddress string, ipv4Address string) (bool, error)
 	DoesMACAddressMapToIPV6Address(macAddress string, ipv4Address string) (bool, error)
-	SetupContainerNamespace(args *skel.CmdArgs, deviceName string, macAddress string,
+	IsEFAOnlyENI(macAddress string) (bool, error)
+	GetIPV6Prefixes(macAddress string) ([]*net.IPNet, error)
+	DoesMACAddressMapToIPV6Prefix(macAddress string, ipv6Address string) (bool, error)
+	SetupContainerNamespace(args *skel.CmdArgs, deviceName string, macAddress string, eniID string,
 		ipv4Address string, ipv6Address string,
 		ipv4Gateway string, ipv6Gateway string, blockIMDS bool) error
-	TeardownContainerNamespace(netns string, macAddress string) error
+	SetupContainerNamespaceEFAOnly(args *skel.CmdArgs, deviceName string, macAddress string, eniID string) error
+	SetupContainerNamespaceFromIPV6Prefix(args *skel.CmdArgs, deviceName string, macAddress string, eniID string,
+		ipv6Address string, ipv6Gateway string, blockIMDS bool) error
+	TeardownContainerNamespace(args *skel.CmdArgs, macAddress string) error
+	CheckContainerNamespace(args *skel.CmdArgs) error
 }
 
 type engine struct {
@@ -75,28 +91,44 @@ type engine struct {
 	maxTicksForRetrievingIPV6Gateway int
 	metadataMaxRetryCount            int
 	metadataDurationBetweenRetries   time.Duration
+	// useRouteTableIPv6Gateway makes GetIPV6Gateway fall back to the old
+	// behavior of polling the routing table for a default ipv6 route,
+	// instead of using the well-known link-local gateway address. This
+	// exists for backward compat only; new callers shouldn't need it.
+	useRouteTableIPv6Gateway bool
+	// state records the ENI/MAC/IP mapping chosen for each container's
+	// network namespace, so that TeardownContainerNamespace and
+	// CheckContainerNamespace don't depend on the caller replaying it.
+	state state.Store
 }
 
-// New creates a new Engine object
-func New() Engine {
+// New creates a new Engine object that persists per-container ENI state
+// under stateDir (state.DefaultDir is used if stateDir is empty)
+func New(useRouteTableIPv6Gateway bool, stateDir string) Engine {
 	return create(
 		ec2metadata.NewEC2Metadata(),
 		netlinkwrapper.NewNetLink(),
-		cninswrapper.NewNS())
+		cninswrapper.NewNS(),
+		useRouteTableIPv6Gateway,
+		state.NewFileStore(stateDir))
 }
 
 func create(metadata ec2metadata.EC2Metadata,
 	netLink netlinkwrapper.NetLink,
 	ns cninswrapper.NS,
+	useRouteTableIPv6Gateway bool,
+	eniState state.Store,
 ) Engine {
 	return &engine{
-		metadata: metadata,
-		netLink:  netLink,
-		ns:       ns,
+		metadata:                         metadata,
+		netLink:                          netLink,
+		ns:                               ns,
 		ipv6GatewayTickDuration:          ipv6GatewayTickDuration,
 		maxTicksForRetrievingIPV6Gateway: maxTicksForRetrievingIPV6Gateway,
 		metadataMaxRetryCount:            instanceMetadataMaxRetryCount,
 		metadataDurationBetweenRetries:   instanceMetadataDurationBetweenRetries,
+		useRouteTableIPv6Gateway:         useRouteTableIPv6Gateway,
+		state:                            eniState,
 	}
 }
 
@@ -160,7 +192,11 @@ func (engine *engine) GetIPV4GatewayNetmask(macAddress string) (string, string,
 }
 
 // GetIPV6PrefixLength gets the ipv6 subnet mask from the instance
-// metadata, given a mac address
+// metadata, given a mac address. This is the subnet's prefix length (eg
+// /64), used to assign a directly-assigned secondary ipv6 address; it's
+// unrelated to the delegated ipv6 prefix (eg a /80) that GetIPV6Prefixes
+// returns, which comes from a separate metadata field and exists to carve
+// out addresses instead of consuming individually-assigned ones.
 func (engine *engine) GetIPV6PrefixLength(macAddress string) (string, error) {
 	// TODO Use fmt.Sprintf and wrap that in a method
 	cidrBlock, err := engine.metadata.GetMetadata(metadataNetworkInterfacesPath + macAddress + metadataNetworkInterfaceIPV6CIDRPathSuffix)
@@ -184,8 +220,15 @@ func getIPV6PrefixLength(cidrBlock string) (string, error) {
 	return fmt.Sprintf("%d", maskOnes), nil
 }
 
-// GetIPV6Gateway gets the ipv6 address of the subnet gateway
+// GetIPV6Gateway gets the ipv6 address of the subnet gateway. Unless the
+// engine was constructed with useRouteTableIPv6Gateway set, this just
+// defers to GetIPV6GatewayLinkLocal, which doesn't need to wait on the
+// kernel populating a route.
 func (engine *engine) GetIPV6Gateway(deviceName string) (string, error) {
+	if !engine.useRouteTableIPv6Gateway {
+		return engine.GetIPV6GatewayLinkLocal(deviceName)
+	}
+
 	// Get the device link for the ENI
 	eniLink, err := engine.netLink.LinkByName(deviceName)
 	if err != nil {
@@ -197,6 +240,20 @@ func (engine *engine) GetIPV6Gateway(deviceName string) (string, error) {
 		engine.maxTicksForRetrievingIPV6Gateway, engine.ipv6GatewayTickDuration)
 }
 
+// GetIPV6GatewayLinkLocal returns the well-known link-local gateway address
+// that AWS VPC always answers IPv6 traffic at off of an ENI, scoped to the
+// given device. This avoids the multi-second latency spike that comes from
+// waiting for the kernel to populate a default ipv6 route for secondary
+// ENIs.
+func (engine *engine) GetIPV6GatewayLinkLocal(deviceName string) (string, error) {
+	if _, err := engine.netLink.LinkByName(deviceName); err != nil {
+		return "", errors.Wrapf(err,
+			"getIPV6GatewayLinkLocal engine: unable to get link for device '%s'", deviceName)
+	}
+
+	return fmt.Sprintf("%s%%%s", linkLocalIPV6Gateway, deviceName), nil
+}
+
 func (engine *engine) getIPV6GatewayIPFromRoutes(link netlink.Link,
 	deviceName string,
 	maxTicks int,
@@ -271,10 +328,121 @@ func (engine *engine) DoesMACAddressMapToIPV6Address(macAddress string, ipv6Addr
 	return ok, nil
 }
 
+// IsEFAOnlyENI determines whether the ENI with the given mac address is an
+// EFA-only interface, ie one that has no local-ipv4s and no ipv6s entries in
+// instance metadata. Newer instance types (eg p5, trn1) expose such
+// interfaces for EFA traffic alongside the regular, IP-addressable ENIs.
+//
+// A still-provisioning, non-EFA ENI can transiently list an incomplete set
+// of fields while instance metadata catches up, which would otherwise look
+// identical to a genuine EFA-only ENI. To guard against that, a positive
+// result is only trusted once it's observed twice in a row, a
+// metadataDurationBetweenRetries apart.
+func (engine *engine) IsEFAOnlyENI(macAddress string) (bool, error) {
+	efaOnly, err := engine.isEFAOnlyENIOnce(macAddress)
+	if err != nil || !efaOnly {
+		return efaOnly, err
+	}
+
+	time.Sleep(engine.metadataDurationBetweenRetries)
+	return engine.isEFAOnlyENIOnce(macAddress)
+}
+
+func (engine *engine) isEFAOnlyENIOnce(macAddress string) (bool, error) {
+	fields, err := engine.metadata.GetMetadata(
+		metadataNetworkInterfacesPath + macAddress + metadataNetworkInterfaceFieldsPathSuffix)
+	if err != nil {
+		return false, errors.Wrapf(err,
+			"isEFAOnlyENI engine: unable to list metadata fields for mac address '%s'", macAddress)
+	}
+
+	hasIPV4 := false
+	hasIPV6 := false
+	for _, field := range strings.Split(fields, "\n") {
+		switch field {
+		case strings.TrimPrefix(metadataNetworkInterfaceIPV4AddressesSuffix, "/"):
+			hasIPV4 = true
+		case strings.TrimPrefix(metadataNetworkInterfaceIPV6AddressesSuffix, "/"):
+			hasIPV6 = true
+		}
+	}
+
+	return !hasIPV4 && !hasIPV6, nil
+}
+
+// GetIPV6Prefixes gets the ipv6 prefixes delegated to the ENI with the given
+// mac address. A delegated prefix (eg a /80) lets the caller carve out
+// addresses for containers instead of consuming individually-assigned
+// secondary ipv6 addresses.
+func (engine *engine) GetIPV6Prefixes(macAddress string) ([]*net.IPNet, error) {
+	response, err := engine.metadata.GetMetadata(
+		metadataNetworkInterfacesPath + macAddress + metadataNetworkInterfaceIPV6PrefixSuffix)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"getIPV6Prefixes engine: unable to get ipv6 prefixes for mac address '%s' from instance metadata", macAddress)
+	}
+
+	var prefixes []*net.IPNet
+	for _, cidrBlock := range strings.Split(response, "\n") {
+		if cidrBlock == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidrBlock)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"getIPV6Prefixes engine: unable to parse delegated ipv6 prefix '%s' for mac address '%s'",
+				cidrBlock, macAddress)
+		}
+		prefixes = append(prefixes, ipNet)
+	}
+
+	return prefixes, nil
+}
+
+// DoesMACAddressMapToIPV6Prefix validates that the ipv6 address given falls
+// within one of the ipv6 prefixes delegated to the ENI with the given mac
+// address. ipv6Address may be a bare address or in address/prefixlen form,
+// matching the same parameter as passed to SetupContainerNamespaceFromIPV6Prefix.
+func (engine *engine) DoesMACAddressMapToIPV6Prefix(macAddress string, ipv6Address string) (bool, error) {
+	prefixes, err := engine.GetIPV6Prefixes(macAddress)
+	if err != nil {
+		return false, errors.Wrap(err,
+			"doesMACAddressMapToIPV6Prefix engine: unable to get ipv6 prefixes from instance metadata")
+	}
+
+	ip := net.ParseIP(ipv6Address)
+	if ip == nil {
+		if host, _, err := net.ParseCIDR(ipv6Address); err == nil {
+			ip = host
+		}
+	}
+	if ip == nil {
+		return false, errors.Errorf(
+			"doesMACAddressMapToIPV6Prefix engine: unable to parse ipv6 address '%s'", ipv6Address)
+	}
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (engine *engine) doesMACAddressMapToIPAddress(macAddress string, addressToFind string, metatdataPathSuffix string) (bool, error) {
+	// EFA-only ENIs have no local-ipv4s/ipv6s entries at all. Without this
+	// check, we'd burn through metadataMaxRetryCount retries below before
+	// giving up, on every invocation, for every EFA-only ENI.
+	efaOnly, err := engine.IsEFAOnlyENI(macAddress)
+	if err != nil {
+		log.Warnf("Error determining if mac address '%s' is an EFA-only ENI: %v", macAddress, err)
+	} else if efaOnly {
+		return false, nil
+	}
+
 	// TODO Use fmt.Sprintf and wrap that in a method
 	var addressesResponse string
-	var err error
 
 	attempts := 1
 	for {
@@ -310,15 +478,29 @@ func (engine *engine) doesMACAddressMapToIPAddress(macAddress string, addressToF
 
 // SetupContainerNamespace configures the network namespace of the container with
 // the ipv4 address and routes to use the ENI interface. The ipv4 address is of the
-// ipv4-address/netmask format
+// ipv4-address/netmask format. It is idempotent: if state was already
+// recorded for this container and namespace (eg because the agent retried
+// after a restart), it does nothing.
 func (engine *engine) SetupContainerNamespace(args *skel.CmdArgs,
 	deviceName string,
 	macAddress string,
+	eniID string,
 	ipv4Address string,
 	ipv6Address string,
 	ipv4Gateway string,
 	ipv6Gateway string,
 	blockIMDS bool) error {
+	existing, err := engine.state.Get(args.ContainerID, args.Netns)
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespace engine: unable to read existing state")
+	}
+	if existing != nil {
+		log.Infof("ENI '%s' already set up for container '%s' in namespace '%s', skipping",
+			existing.ENIID, args.ContainerID, args.Netns)
+		return nil
+	}
+
 	// Get the device link for the ENI
 	eniLink, err := engine.netLink.LinkByName(deviceName)
 	if err != nil {
@@ -354,11 +536,188 @@ func (engine *engine) SetupContainerNamespace(args *skel.CmdArgs,
 		return errors.Wrapf(err,
 			"setupContainerNamespace engine: unable to setup device '%s' in namespace '%s'", deviceName, args.Netns)
 	}
+
+	err = engine.state.Save(args.ContainerID, args.Netns, &state.ENIState{
+		ENIID:       eniID,
+		MACAddress:  macAddress,
+		IPV4Address: ipv4Address,
+		IPV6Address: ipv6Address,
+		IPV4Gateway: ipv4Gateway,
+		IPV6Gateway: ipv6Gateway,
+		DeviceName:  args.IfName,
+		BlockIMDS:   blockIMDS,
+	})
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespace engine: unable to persist state after setup")
+	}
+
 	return nil
 }
 
-// TeardownContainerNamespace brings down the ENI device in the container's namespace
-func (engine *engine) TeardownContainerNamespace(netns string, macAddress string) error {
+// SetupContainerNamespaceEFAOnly moves an EFA-only ENI device into the
+// container's network namespace and brings it up, without assigning any
+// addresses, gateways, or default routes, since EFA-only ENIs don't carry
+// any IP addresses. Like SetupContainerNamespace, it's idempotent and
+// persists state so that TeardownContainerNamespace can later recover the
+// mac address without the caller replaying it.
+func (engine *engine) SetupContainerNamespaceEFAOnly(args *skel.CmdArgs, deviceName string, macAddress string, eniID string) error {
+	existing, err := engine.state.Get(args.ContainerID, args.Netns)
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespaceEFAOnly engine: unable to read existing state")
+	}
+	if existing != nil {
+		log.Infof("ENI '%s' already set up for container '%s' in namespace '%s', skipping",
+			existing.ENIID, args.ContainerID, args.Netns)
+		return nil
+	}
+
+	// Get the device link for the ENI
+	eniLink, err := engine.netLink.LinkByName(deviceName)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceEFAOnly engine: unable to get link for device '%s'", deviceName)
+	}
+
+	// Get the handle for the container's network namespace
+	containerNS, err := engine.ns.GetNS(args.Netns)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceEFAOnly engine: unable to get network namespace for '%s'", args.Netns)
+	}
+
+	// Assign the ENI device to container's network namespace
+	err = engine.netLink.LinkSetNsFd(eniLink, int(containerNS.Fd()))
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceEFAOnly engine: unable to move device '%s' to container namespace '%s'", deviceName, args.Netns)
+	}
+
+	// Generate the closure to execute within the container's namespace
+	toRun, err := newSetupNamespaceClosureContextEFAOnly(engine.netLink, args.IfName, deviceName, macAddress)
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespaceEFAOnly engine: unable to create closure to execute in container namespace")
+	}
+
+	// Execute the closure within the container's namespace
+	err = engine.ns.WithNetNSPath(args.Netns, toRun.run)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceEFAOnly engine: unable to setup device '%s' in namespace '%s'", deviceName, args.Netns)
+	}
+
+	err = engine.state.Save(args.ContainerID, args.Netns, &state.ENIState{
+		ENIID:      eniID,
+		MACAddress: macAddress,
+		DeviceName: args.IfName,
+	})
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespaceEFAOnly engine: unable to persist state after setup")
+	}
+
+	return nil
+}
+
+// SetupContainerNamespaceFromIPV6Prefix moves the ENI device into the
+// container's network namespace and assigns it an address carved out of the
+// ENI's delegated ipv6 prefix, instead of a shared secondary ipv6 address.
+// It also wires up a proxy neighbor entry so the ENI answers neighbor
+// solicitations for the carved address and, when ipv6Gateway is set, a
+// default route via that gateway. No route specific to the carved address
+// itself is added.
+func (engine *engine) SetupContainerNamespaceFromIPV6Prefix(args *skel.CmdArgs,
+	deviceName string,
+	macAddress string,
+	eniID string,
+	ipv6Address string,
+	ipv6Gateway string,
+	blockIMDS bool) error {
+	existing, err := engine.state.Get(args.ContainerID, args.Netns)
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to read existing state")
+	}
+	if existing != nil {
+		log.Infof("ENI '%s' already set up for container '%s' in namespace '%s', skipping",
+			existing.ENIID, args.ContainerID, args.Netns)
+		return nil
+	}
+
+	// Get the device link for the ENI
+	eniLink, err := engine.netLink.LinkByName(deviceName)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to get link for device '%s'", deviceName)
+	}
+
+	// Get the handle for the container's network namespace
+	containerNS, err := engine.ns.GetNS(args.Netns)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to get network namespace for '%s'", args.Netns)
+	}
+
+	// Assign the ENI device to container's network namespace
+	err = engine.netLink.LinkSetNsFd(eniLink, int(containerNS.Fd()))
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to move device '%s' to container namespace '%s'", deviceName, args.Netns)
+	}
+
+	// Generate the closure to execute within the container's namespace
+	toRun, err := newSetupNamespaceClosureContextFromIPV6Prefix(engine.netLink, args.IfName, deviceName, macAddress,
+		ipv6Address, ipv6Gateway, blockIMDS)
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to create closure to execute in container namespace")
+	}
+
+	// Execute the closure within the container's namespace
+	err = engine.ns.WithNetNSPath(args.Netns, toRun.run)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to setup device '%s' in namespace '%s'", deviceName, args.Netns)
+	}
+
+	err = engine.state.Save(args.ContainerID, args.Netns, &state.ENIState{
+		ENIID:       eniID,
+		MACAddress:  macAddress,
+		IPV6Address: ipv6Address,
+		IPV6Gateway: ipv6Gateway,
+		DeviceName:  args.IfName,
+		BlockIMDS:   blockIMDS,
+	})
+	if err != nil {
+		return errors.Wrap(err,
+			"setupContainerNamespaceFromIPV6Prefix engine: unable to persist state after setup")
+	}
+
+	return nil
+}
+
+// TeardownContainerNamespace brings down the ENI device in the container's
+// namespace. If macAddress is empty, it's recovered from the state recorded
+// for args.ContainerID/args.Netns by an earlier SetupContainerNamespace,
+// which lets a caller that lost track of the mapping (eg an agent restart
+// or a kubelet DEL replay) still tear things down correctly.
+func (engine *engine) TeardownContainerNamespace(args *skel.CmdArgs, macAddress string) error {
+	if macAddress == "" {
+		existing, err := engine.state.Get(args.ContainerID, args.Netns)
+		if err != nil {
+			return errors.Wrap(err,
+				"teardownContainerNamespace engine: unable to read existing state")
+		}
+		if existing == nil {
+			return errors.Errorf(
+				"teardownContainerNamespace engine: no mac address given and no state recorded for container '%s' namespace '%s'",
+				args.ContainerID, args.Netns)
+		}
+		macAddress = existing.MACAddress
+	}
+
 	// Generate the closure to execute within the container's namespace
 	toRun, err := newTeardownNamespaceClosureContext(engine.netLink,
 		macAddress)
@@ -368,10 +727,46 @@ func (engine *engine) TeardownContainerNamespace(netns string, macAddress string
 	}
 
 	// Execute the closure within the container's namespace
-	err = engine.ns.WithNetNSPath(netns, toRun.run)
+	err = engine.ns.WithNetNSPath(args.Netns, toRun.run)
 	if err != nil {
 		return errors.Wrap(err,
 			"teardownContainerNamespace engine: unable to teardown container namespace")
 	}
+
+	if err := engine.state.Remove(args.ContainerID, args.Netns); err != nil {
+		return errors.Wrap(err,
+			"teardownContainerNamespace engine: unable to remove persisted state")
+	}
+
+	return nil
+}
+
+// CheckContainerNamespace verifies that the state recorded for
+// args.ContainerID/args.Netns still matches what's live in the container's
+// network namespace: the device exists, carries the recorded mac address,
+// and (when recorded) the expected ipv4/ipv6 addresses.
+func (engine *engine) CheckContainerNamespace(args *skel.CmdArgs) error {
+	existing, err := engine.state.Get(args.ContainerID, args.Netns)
+	if err != nil {
+		return errors.Wrap(err,
+			"checkContainerNamespace engine: unable to read existing state")
+	}
+	if existing == nil {
+		return errors.Errorf(
+			"checkContainerNamespace engine: no state recorded for container '%s' namespace '%s'",
+			args.ContainerID, args.Netns)
+	}
+
+	toRun, err := newCheckNamespaceClosureContext(engine.netLink, existing)
+	if err != nil {
+		return errors.Wrap(err,
+			"checkContainerNamespace engine: unable to create closure to execute in container namespace")
+	}
+
+	if err := engine.ns.WithNetNSPath(args.Netns, toRun.run); err != nil {
+		return errors.Wrap(err,
+			"checkContainerNamespace engine: recorded state does not match live namespace state")
+	}
+
 	return nil
 }
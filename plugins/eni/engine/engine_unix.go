@@ -0,0 +1,360 @@
+// Copyright 2017 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build linux
+// +build linux
+
+package engine
+
+import (
+	"net"
+	"strings"
+
+	"github.com/aws/amazon-ecs-cni-plugins/pkg/netlinkwrapper"
+	"github.com/aws/amazon-ecs-cni-plugins/pkg/state"
+	log "github.com/cihub/seelog"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// setupNamespaceClosureContext holds all of the information needed to move
+// an ENI device into a container's network namespace and configure it there
+type setupNamespaceClosureContext struct {
+	netLink     netlinkwrapper.NetLink
+	ifName      string
+	deviceName  string
+	macAddress  string
+	ipv4Address string
+	ipv6Address string
+	ipv4Gateway string
+	ipv6Gateway string
+	blockIMDS   bool
+	efaOnly     bool
+	// fromIPV6Prefix indicates that ipv6Address was carved out of the ENI's
+	// delegated ipv6 prefix, rather than assigned as an individual secondary
+	// address. Such addresses need a proxy neighbor entry so the ENI answers
+	// neighbor solicitations for them.
+	fromIPV6Prefix bool
+}
+
+// newSetupNamespaceClosureContext creates a new setupNamespaceClosureContext
+// for the non-EFA-only case
+func newSetupNamespaceClosureContext(netLink netlinkwrapper.NetLink,
+	ifName string,
+	deviceName string,
+	macAddress string,
+	ipv4Address string,
+	ipv6Address string,
+	ipv4Gateway string,
+	ipv6Gateway string,
+	blockIMDS bool) (*setupNamespaceClosureContext, error) {
+	return &setupNamespaceClosureContext{
+		netLink:     netLink,
+		ifName:      ifName,
+		deviceName:  deviceName,
+		macAddress:  macAddress,
+		ipv4Address: ipv4Address,
+		ipv6Address: ipv6Address,
+		ipv4Gateway: ipv4Gateway,
+		ipv6Gateway: ipv6Gateway,
+		blockIMDS:   blockIMDS,
+	}, nil
+}
+
+// newSetupNamespaceClosureContextEFAOnly creates a new
+// setupNamespaceClosureContext for an EFA-only ENI, which has no IP
+// addresses, gateways, or routes to configure
+func newSetupNamespaceClosureContextEFAOnly(netLink netlinkwrapper.NetLink,
+	ifName string,
+	deviceName string,
+	macAddress string) (*setupNamespaceClosureContext, error) {
+	return &setupNamespaceClosureContext{
+		netLink:    netLink,
+		ifName:     ifName,
+		deviceName: deviceName,
+		macAddress: macAddress,
+		efaOnly:    true,
+	}, nil
+}
+
+// newSetupNamespaceClosureContextFromIPV6Prefix creates a new
+// setupNamespaceClosureContext for an ipv6 address carved out of a
+// delegated prefix
+func newSetupNamespaceClosureContextFromIPV6Prefix(netLink netlinkwrapper.NetLink,
+	ifName string,
+	deviceName string,
+	macAddress string,
+	ipv6Address string,
+	ipv6Gateway string,
+	blockIMDS bool) (*setupNamespaceClosureContext, error) {
+	return &setupNamespaceClosureContext{
+		netLink:        netLink,
+		ifName:         ifName,
+		deviceName:     deviceName,
+		macAddress:     macAddress,
+		ipv6Address:    ipv6Address,
+		ipv6Gateway:    ipv6Gateway,
+		blockIMDS:      blockIMDS,
+		fromIPV6Prefix: true,
+	}, nil
+}
+
+// run executes within the container's network namespace. It renames the ENI
+// device to the requested interface name and brings it up. For EFA-only
+// ENIs, that's all that's needed: there are no addresses, gateways, or
+// routes to configure. Otherwise, it assigns the ipv4/ipv6 addresses and
+// default routes.
+func (closureContext *setupNamespaceClosureContext) run(_ ns.NetNS) error {
+	eniLink, err := closureContext.netLink.LinkByName(closureContext.deviceName)
+	if err != nil {
+		return errors.Wrapf(err,
+			"setupNamespaceClosureContext run: unable to get link for device '%s'", closureContext.deviceName)
+	}
+
+	if err := closureContext.netLink.LinkSetName(eniLink, closureContext.ifName); err != nil {
+		return errors.Wrapf(err,
+			"setupNamespaceClosureContext run: unable to rename device '%s' to '%s'",
+			closureContext.deviceName, closureContext.ifName)
+	}
+
+	if err := closureContext.netLink.LinkSetUp(eniLink); err != nil {
+		return errors.Wrapf(err,
+			"setupNamespaceClosureContext run: unable to bring up device '%s'", closureContext.ifName)
+	}
+
+	if closureContext.efaOnly {
+		log.Infof("Device '%s' is an EFA-only ENI, skipping address and route configuration", closureContext.ifName)
+		return nil
+	}
+
+	return closureContext.configureAddressesAndRoutes(eniLink)
+}
+
+func (closureContext *setupNamespaceClosureContext) configureAddressesAndRoutes(eniLink netlink.Link) error {
+	if closureContext.ipv4Address != "" {
+		ipv4Addr, err := netlink.ParseAddr(closureContext.ipv4Address)
+		if err != nil {
+			return errors.Wrapf(err,
+				"setupNamespaceClosureContext run: unable to parse ipv4 address '%s'", closureContext.ipv4Address)
+		}
+		if err := closureContext.netLink.AddrAdd(eniLink, ipv4Addr); err != nil {
+			return errors.Wrapf(err,
+				"setupNamespaceClosureContext run: unable to add ipv4 address '%s' to device '%s'",
+				closureContext.ipv4Address, closureContext.ifName)
+		}
+	}
+
+	if closureContext.ipv6Address != "" {
+		ipv6Addr, err := netlink.ParseAddr(closureContext.ipv6Address)
+		if err != nil {
+			return errors.Wrapf(err,
+				"setupNamespaceClosureContext run: unable to parse ipv6 address '%s'", closureContext.ipv6Address)
+		}
+		if err := closureContext.netLink.AddrAdd(eniLink, ipv6Addr); err != nil {
+			return errors.Wrapf(err,
+				"setupNamespaceClosureContext run: unable to add ipv6 address '%s' to device '%s'",
+				closureContext.ipv6Address, closureContext.ifName)
+		}
+
+		if closureContext.fromIPV6Prefix {
+			if err := closureContext.addProxyNeighbor(eniLink, ipv6Addr.IP); err != nil {
+				return err
+			}
+		}
+	}
+
+	if closureContext.ipv4Gateway != "" {
+		if err := closureContext.addDefaultRoute(eniLink, closureContext.ipv4Gateway, netlink.FAMILY_V4); err != nil {
+			return err
+		}
+	}
+
+	if closureContext.ipv6Gateway != "" {
+		if err := closureContext.addDefaultRoute(eniLink, closureContext.ipv6Gateway, netlink.FAMILY_V6); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addProxyNeighbor instructs the kernel to answer neighbor solicitations
+// for ip on eniLink's behalf. Addresses carved out of a delegated ipv6
+// prefix otherwise aren't known to the ENI's usual neighbor discovery
+// handling the way a directly-assigned secondary address is.
+func (closureContext *setupNamespaceClosureContext) addProxyNeighbor(eniLink netlink.Link, ip net.IP) error {
+	neigh := &netlink.Neigh{
+		LinkIndex: eniLink.Attrs().Index,
+		Family:    netlink.FAMILY_V6,
+		Flags:     netlink.NTF_PROXY,
+		IP:        ip,
+	}
+	if err := closureContext.netLink.NeighAdd(neigh); err != nil {
+		return errors.Wrapf(err,
+			"setupNamespaceClosureContext run: unable to add proxy neighbor entry for '%s' on device '%s'",
+			ip.String(), closureContext.ifName)
+	}
+
+	return nil
+}
+
+func (closureContext *setupNamespaceClosureContext) addDefaultRoute(eniLink netlink.Link, gateway string, family int) error {
+	// Link-local gateway addresses (eg the fe80::1 ipv6 gateway) are scoped
+	// with a "%<device>" zone suffix that net.ParseIP doesn't understand;
+	// the route's LinkIndex already conveys that scope, so strip it.
+	if idx := strings.IndexByte(gateway, '%'); idx != -1 {
+		gateway = gateway[:idx]
+	}
+
+	gatewayIP := net.ParseIP(gateway)
+	if gatewayIP == nil {
+		return errors.Errorf(
+			"setupNamespaceClosureContext run: unable to parse gateway ip '%s'", gateway)
+	}
+
+	// The route is written into the main routing table (Table left unset).
+	// A namespace-scoped table is only consulted if a matching ip rule
+	// directs traffic to it, and the container's namespace holds exactly
+	// one ENI, so there's no collision for a separate table to avoid here.
+	route := &netlink.Route{
+		LinkIndex: eniLink.Attrs().Index,
+		Gw:        gatewayIP,
+	}
+	if err := closureContext.netLink.RouteAdd(route); err != nil {
+		return errors.Wrapf(err,
+			"setupNamespaceClosureContext run: unable to add default route via '%s' on device '%s'",
+			gateway, closureContext.ifName)
+	}
+
+	return nil
+}
+
+// teardownNamespaceClosureContext holds the information needed to bring down
+// an ENI device within a container's network namespace
+type teardownNamespaceClosureContext struct {
+	netLink    netlinkwrapper.NetLink
+	macAddress string
+}
+
+// newTeardownNamespaceClosureContext creates a new
+// teardownNamespaceClosureContext
+func newTeardownNamespaceClosureContext(netLink netlinkwrapper.NetLink,
+	macAddress string) (*teardownNamespaceClosureContext, error) {
+	return &teardownNamespaceClosureContext{
+		netLink:    netLink,
+		macAddress: macAddress,
+	}, nil
+}
+
+// run executes within the container's network namespace and brings down the
+// ENI device identified by macAddress
+func (closureContext *teardownNamespaceClosureContext) run(_ ns.NetNS) error {
+	hardwareAddr, err := net.ParseMAC(closureContext.macAddress)
+	if err != nil {
+		return errors.Wrapf(err,
+			"teardownNamespaceClosureContext run: malformatted mac address specified '%s'", closureContext.macAddress)
+	}
+
+	eniLink, err := getLinkByHardwareAddress(closureContext.netLink, hardwareAddr)
+	if err != nil {
+		return errors.Wrapf(err,
+			"teardownNamespaceClosureContext run: unable to get device with hardware address '%s'", closureContext.macAddress)
+	}
+
+	if err := closureContext.netLink.LinkSetDown(eniLink); err != nil {
+		return errors.Wrapf(err,
+			"teardownNamespaceClosureContext run: unable to bring down device '%s'", eniLink.Attrs().Name)
+	}
+
+	return nil
+}
+
+// checkNamespaceClosureContext holds the recorded state to verify against
+// the live network namespace
+type checkNamespaceClosureContext struct {
+	netLink  netlinkwrapper.NetLink
+	expected *state.ENIState
+}
+
+// newCheckNamespaceClosureContext creates a new checkNamespaceClosureContext
+func newCheckNamespaceClosureContext(netLink netlinkwrapper.NetLink,
+	expected *state.ENIState) (*checkNamespaceClosureContext, error) {
+	return &checkNamespaceClosureContext{
+		netLink:  netLink,
+		expected: expected,
+	}, nil
+}
+
+// run executes within the container's network namespace and verifies that
+// the device named in the recorded state exists, carries the recorded mac
+// address, and (when recorded) the expected ipv4/ipv6 addresses
+func (closureContext *checkNamespaceClosureContext) run(_ ns.NetNS) error {
+	eniLink, err := closureContext.netLink.LinkByName(closureContext.expected.DeviceName)
+	if err != nil {
+		return errors.Wrapf(err,
+			"checkNamespaceClosureContext run: unable to get link for device '%s'", closureContext.expected.DeviceName)
+	}
+
+	if eniLink.Attrs().HardwareAddr.String() != closureContext.expected.MACAddress {
+		return errors.Errorf(
+			"checkNamespaceClosureContext run: device '%s' has mac address '%s', expected '%s'",
+			closureContext.expected.DeviceName, eniLink.Attrs().HardwareAddr.String(), closureContext.expected.MACAddress)
+	}
+
+	addrs, err := closureContext.netLink.AddrList(eniLink, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err,
+			"checkNamespaceClosureContext run: unable to list addresses for device '%s'", closureContext.expected.DeviceName)
+	}
+
+	for _, expectedAddr := range []string{closureContext.expected.IPV4Address, closureContext.expected.IPV6Address} {
+		if expectedAddr == "" {
+			continue
+		}
+		if !hasAddress(addrs, expectedAddr) {
+			return errors.Errorf(
+				"checkNamespaceClosureContext run: device '%s' is missing expected address '%s'",
+				closureContext.expected.DeviceName, expectedAddr)
+		}
+	}
+
+	return nil
+}
+
+func hasAddress(addrs []netlink.Addr, expected string) bool {
+	for _, addr := range addrs {
+		if addr.IPNet != nil && addr.IPNet.String() == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// getLinkByHardwareAddress returns the netlink.Link that has the given
+// hardware address
+func getLinkByHardwareAddress(netLink netlinkwrapper.NetLink, hardwareAddr net.HardwareAddr) (netlink.Link, error) {
+	links, err := netLink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "getLinkByHardwareAddress: unable to list links")
+	}
+
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == hardwareAddr.String() {
+			return link, nil
+		}
+	}
+
+	return nil, errors.Errorf(
+		"getLinkByHardwareAddress: no link found with hardware address '%s'", hardwareAddr.String())
+}